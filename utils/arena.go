@@ -3,12 +3,14 @@ package utils
 import (
 	"github.com/pkg/errors"
 	"log"
+	"os"
 	"sync/atomic"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
-	offsetSize  = int(unsafe.Sizeof(uint32(0)))
 	nodeAlign   = int(unsafe.Sizeof(uint64(0))) - 1
 	MaxNodeSize = int(unsafe.Sizeof(node{}))
 )
@@ -17,6 +19,19 @@ type Arena struct {
 	n          uint32
 	shouldGrow bool
 	buf        []byte
+
+	// fd 非空时, buf 是该文件 mmap 出来的内存, 而不是普通的 Go slice,
+	// 扩容和关闭都需要走 mmap 相关的系统调用。
+	fd *os.File
+
+	// retired 保存 remap 之前被替换下来的旧 mmap 映射。
+	// 跳表的读路径是无锁的, 可能有协程正持有一个在 remap 前取到的 *node 或
+	// []byte, 其中的指针落在旧映射里; remap 时如果立刻 munmap 旧映射,
+	// 这些指针就会变成悬空指针。由于每次 mmap 都是从文件偏移 0 开始映射
+	// 整个文件, arena 内部记录的都是相对文件开头的 uint32 offset, 所以旧
+	// 映射和新映射在重叠的范围内指向同一份内容 —— 旧映射继续保留着也不影响
+	// 正确性, 只是多占一点虚拟地址空间。真正 munmap 它们的时机推迟到 close()。
+	retired [][]byte
 }
 
 func newArena(n int64) *Arena {
@@ -26,6 +41,74 @@ func newArena(n int64) *Arena {
 	}
 }
 
+// newArenaFromFile 把 path 文件 mmap 成 n 字节的内存, 作为 Arena 的底层 buf,
+// 这样基于这块 Arena 的跳表数据可以跨进程重启持久化下来。
+func newArenaFromFile(path string, n int64) (*Arena, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while opening %s", path)
+	}
+	if err := fd.Truncate(n); err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, "while truncating %s", path)
+	}
+	buf, err := unix.Mmap(int(fd.Fd()), 0, int(n), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, "while mmapping %s", path)
+	}
+	return &Arena{
+		n:   1,
+		buf: buf,
+		fd:  fd,
+	}, nil
+}
+
+// remap 把底层文件 truncate 到 newSize, 再重新 mmap 一块新的映射出来。
+// 只有 fd 非空(即文件支持的 Arena)才会走到这里。
+//
+// 旧的映射不会在这里被 munmap: 无锁跳表的读者可能正持有指向旧映射的指针,
+// 立刻解除映射会让这些指针悬空。旧映射被记到 s.retired 里, 留到 close()
+// 再统一释放。
+func (s *Arena) remap(newSize int) error {
+	if err := s.fd.Truncate(int64(newSize)); err != nil {
+		return errors.Wrapf(err, "while truncating arena file")
+	}
+	buf, err := unix.Mmap(int(s.fd.Fd()), 0, newSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return errors.Wrapf(err, "while remapping arena file")
+	}
+	s.retired = append(s.retired, s.buf)
+	s.buf = buf
+	return nil
+}
+
+// sync 把 mmap 出来的内存刷回磁盘, 非文件支持的 Arena 是空操作。
+func (s *Arena) sync() error {
+	if s.fd == nil {
+		return nil
+	}
+	return unix.Msync(s.buf, unix.MS_SYNC)
+}
+
+// close 解除当前映射以及 remap 过程中积累下来的所有历史映射, 再关闭底层文件。
+// 非文件支持的 Arena 是空操作。
+func (s *Arena) close() error {
+	if s.fd == nil {
+		return nil
+	}
+	for _, buf := range s.retired {
+		if err := unix.Munmap(buf); err != nil {
+			return errors.Wrapf(err, "while unmapping retired arena mapping")
+		}
+	}
+	s.retired = nil
+	if err := unix.Munmap(s.buf); err != nil {
+		return errors.Wrapf(err, "while unmapping arena")
+	}
+	return s.fd.Close()
+}
+
 func (s *Arena) putKey(key []byte) uint32 {
 	keySz := uint32(len(key))
 	offset := s.allocate(keySz)
@@ -59,7 +142,10 @@ func (s *Arena) getVal(offset uint32, size uint32) (ret ValueStruct) {
 }
 
 func (s *Arena) putNode(height int) uint32 {
-	unusedSize := (maxHeight - height) * offsetSize
+	// 每一层的 next/prev 是打包在一起的 link{}, 裁剪尾部用不上的层数时要按
+	// linkSize(而不是单个指针的 offsetSize)来算, 否则会把 prev 那一半算漏,
+	// 裁出来的内存放不下 node 的 tower。
+	unusedSize := (maxHeight - height) * linkSize
 
 	l := uint32(MaxNodeSize - unusedSize + nodeAlign)
 	n := s.allocate(l)
@@ -87,11 +173,18 @@ func (s *Arena) allocate(sz uint32) uint32 {
 		if growBy < sz {
 			growBy = sz
 		}
-		newBuf := make([]byte, len(s.buf)+int(growBy))
-		//这里的操作是RCU, 全量Copy到新的Buf中,然后设置为新的Arena内存值
-		AssertTrue(len(s.buf) == copy(newBuf, s.buf))
-		//这里进行新的赋值
-		s.buf = newBuf
+		newSize := len(s.buf) + int(growBy)
+		if s.fd != nil {
+			// mmap 支持的 Arena 不能像普通 slice 那样 copy 扩容,
+			// 通过 ftruncate + mmap 重新映射到新的大小; 旧映射留到 close() 再 munmap。
+			AssertTrue(s.remap(newSize) == nil)
+		} else {
+			newBuf := make([]byte, newSize)
+			//这里的操作是RCU, 全量Copy到新的Buf中,然后设置为新的Arena内存值
+			AssertTrue(len(s.buf) == copy(newBuf, s.buf))
+			//这里进行新的赋值
+			s.buf = newBuf
+		}
 		// fmt.Print(len(s.buf), " ")
 	}
 	return offset - sz
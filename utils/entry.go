@@ -2,6 +2,9 @@ package utils
 
 import "encoding/binary"
 
+// BitDelete 标记一个 ValueStruct 是删除墓碑, 而不是真正写入的值, 见 Skiplist.Delete。
+const BitDelete byte = 1 << 0
+
 type ValueStruct struct {
 	Meta      byte
 	Value     []byte
@@ -0,0 +1,564 @@
+package utils
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// memBlockSize 是 MemDB 底层每个 arena block 的大小, MemDB 通过不断追加新 block
+// 来扩容, 而不是像 Arena.allocate 那样把已有内存整体 double 拷贝一份 —— 那样做会
+// 让已经发出去的偏移量全部失效, 对于要做 Staging/Release 回滚的事务缓冲区是不可接受的。
+const memBlockSize = 4 << 20 // 4MB
+
+// memAddr 把一次分配的位置压缩成一个 64 位整数: 高 32 位是它所在 block 在 blocks
+// 数组里的下标, 低 32 位是 block 内部的偏移量。block 数组只增不改, 所以旧地址永远
+// 不会因为扩容而失效。memAddr(0) 代表空指针, 和 block 0 里 n 从 1 开始的约定配合使用。
+type memAddr uint64
+
+func packMemAddr(blockIdx, offset uint32) memAddr {
+	return memAddr(uint64(blockIdx)<<32 | uint64(offset))
+}
+
+func (a memAddr) blockIdx() uint32 { return uint32(a >> 32) }
+func (a memAddr) offset() uint32   { return uint32(a) }
+
+// packValueWord / unpackValueWord 把一个 value 的 memAddr 和它的编码长度压进
+// 同一个 64 位字里(16 位 blockIdx + 24 位 offset + 24 位 size), 这样 mnode
+// 可以用一次 64 位原子读写更新 value 指针, 不会出现"地址已经指向新值、长度
+// 还是旧值"的撕裂读。24 位上限每个 block/value 最多 16MB, 相比 memAddr 自己
+// 32 位的 offset 更紧。allocate 按需放大 block 时不检查这个上限, 编码长度
+// 达到 16MB 的 value 会让这里的断言失败。
+func packValueWord(addr memAddr, size uint32) uint64 {
+	AssertTrue(addr.blockIdx() < 1<<16)
+	AssertTrue(addr.offset() < 1<<24)
+	AssertTrue(size < 1<<24)
+	return uint64(addr.blockIdx())<<48 | uint64(addr.offset())<<24 | uint64(size)
+}
+
+func unpackValueWord(w uint64) (memAddr, uint32) {
+	addr := packMemAddr(uint32(w>>48), uint32(w>>24)&0xFFFFFF)
+	size := uint32(w) & 0xFFFFFF
+	return addr, size
+}
+
+// memBlock 是 memArena 里的一块定长内存。
+type memBlock struct {
+	buf []byte
+	n   uint32
+}
+
+func newMemBlock(size uint32) *memBlock {
+	return &memBlock{buf: make([]byte, size), n: 1}
+}
+
+// memArena 是 MemDB 专用的块状 Arena: 单 writer/多 reader, 按固定大小的 block
+// 追加扩容, 并且维护一个按申请大小分类的 freelist, 使得覆盖写释放掉的旧 value
+// 槽位可以被后续同样大小的分配复用, 而不是白白浪费在原 Arena 里。
+type memArena struct {
+	blocks atomic.Value // []*memBlock, 只由 writer 替换, reader 只读
+
+	// freelist[size] 是某个大小的空闲槽位组成的单链表的表头, 链表的 next 指针
+	// 就复用存在被释放的槽位自己的前 8 个字节里。只有单个 writer 会访问它,
+	// 不需要加锁。
+	freelist map[uint32]memAddr
+}
+
+func newMemArena() *memArena {
+	a := &memArena{freelist: make(map[uint32]memAddr)}
+	a.blocks.Store([]*memBlock{newMemBlock(memBlockSize)})
+	return a
+}
+
+func (a *memArena) loadBlocks() []*memBlock {
+	return a.blocks.Load().([]*memBlock)
+}
+
+func (a *memArena) getBytes(addr memAddr, size uint32) []byte {
+	blk := a.loadBlocks()[addr.blockIdx()]
+	off := addr.offset()
+	return blk.buf[off : off+size]
+}
+
+// freePush 把一个刚刚被覆盖写释放掉的槽位挂回对应大小的 freelist。
+func (a *memArena) freePush(addr memAddr, size uint32) {
+	if size < 8 {
+		// 槽位太小放不下一个 next 指针, 直接放弃复用。
+		return
+	}
+	next := a.freelist[size]
+	PutUint64(a.getBytes(addr, size), uint64(next))
+	a.freelist[size] = addr
+}
+
+// freePop 尝试从 freelist 里拿一个同样大小的槽位复用, 拿不到则返回 false。
+func (a *memArena) freePop(size uint32) (memAddr, bool) {
+	addr, ok := a.freelist[size]
+	if !ok || addr == 0 {
+		return 0, false
+	}
+	next := memAddr(GetUint64(a.getBytes(addr, size)))
+	a.freelist[size] = next
+	return addr, true
+}
+
+// allocate 优先复用 freelist 里的空闲槽位, 否则在最后一个 block 里分配,
+// 当前 block 放不下时追加一个新 block(够大则按需放大), 不拷贝已有数据。
+func (a *memArena) allocate(sz uint32) memAddr {
+	if addr, ok := a.freePop(sz); ok {
+		return addr
+	}
+
+	blocks := a.loadBlocks()
+	idx := uint32(len(blocks) - 1)
+	blk := blocks[idx]
+	offset := blk.n + sz
+	if int(offset) > len(blk.buf) {
+		blkSize := uint32(memBlockSize)
+		if sz > blkSize {
+			blkSize = sz
+		}
+		newBlk := newMemBlock(blkSize)
+		blocks = append(blocks[:len(blocks):len(blocks)], newBlk)
+		a.blocks.Store(blocks)
+		idx = uint32(len(blocks) - 1)
+		blk = newBlk
+		offset = blk.n + sz
+	}
+	addr := packMemAddr(idx, blk.n)
+	blk.n = offset
+	return addr
+}
+
+// PutUint64 / GetUint64 是小工具函数, 直接在字节切片上原地读写一个 uint64,
+// 给 freelist 的链表指针复用。
+func PutUint64(b []byte, v uint64) {
+	*(*uint64)(unsafe.Pointer(&b[0])) = v
+}
+
+func GetUint64(b []byte) uint64 {
+	return *(*uint64)(unsafe.Pointer(&b[0]))
+}
+
+// mnode 是 MemDB 跳表节点, 和 Skiplist 的 node 相比, 指针用 8 字节的 memAddr
+// 而不是 4 字节的 Arena 偏移量, 这样才能表示跨 block 的地址; tower 按实际
+// height 分配, 和 node 一样只有前 height 个 slot 真正落在分配出来的内存里。
+type mnode struct {
+	// valueWord 打包了 value 的 memAddr 和编码长度, 见 packValueWord, 覆盖写
+	// 时通过一次原子 store 整体替换, 避免地址和长度分两个字段读写造成的撕裂读。
+	valueWord uint64
+
+	keyAddr memAddr
+	keySize uint16
+
+	height uint16
+
+	tower [maxHeight]memAddr
+}
+
+const maxMNodeSize = int(unsafe.Sizeof(mnode{}))
+
+func (a *memArena) putKey(key []byte) memAddr {
+	addr := a.allocate(uint32(len(key)))
+	AssertTrue(len(key) == copy(a.getBytes(addr, uint32(len(key))), key))
+	return addr
+}
+
+func (a *memArena) putVal(v ValueStruct) (memAddr, uint32) {
+	sz := v.EncodedSize()
+	addr := a.allocate(sz)
+	v.EncodeValue(a.getBytes(addr, sz))
+	return addr, sz
+}
+
+func (a *memArena) putNode(height int) memAddr {
+	unusedSize := (maxHeight - height) * int(unsafe.Sizeof(memAddr(0)))
+	return a.allocate(uint32(maxMNodeSize - unusedSize))
+}
+
+func (a *memArena) getNode(addr memAddr) *mnode {
+	if addr == 0 {
+		return nil
+	}
+	return (*mnode)(unsafe.Pointer(&a.getBytes(addr, 1)[0]))
+}
+
+func (n *mnode) key(a *memArena) []byte {
+	return a.getBytes(n.keyAddr, uint32(n.keySize))
+}
+
+func (n *mnode) getVs(a *memArena) ValueStruct {
+	addr, size := unpackValueWord(atomic.LoadUint64(&n.valueWord))
+	var vs ValueStruct
+	vs.DecodeValue(a.getBytes(addr, size))
+	return vs
+}
+
+func (n *mnode) getNext(a *memArena, h int) *mnode {
+	next := memAddr(atomic.LoadUint64((*uint64)(unsafe.Pointer(&n.tower[h]))))
+	return a.getNode(next)
+}
+
+func (n *mnode) casNextAddr(h int, old, val memAddr) bool {
+	return atomic.CompareAndSwapUint64((*uint64)(unsafe.Pointer(&n.tower[h])), uint64(old), uint64(val))
+}
+
+func (n *mnode) storeNextAddr(h int, val memAddr) {
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&n.tower[h])), uint64(val))
+}
+
+// undoEntry 记录一次被 Staging 之后的 overwrite 覆盖掉的 node 原本的 valueWord,
+// Release 的时候按逆序把它们写回去, 撤销这期间发生的覆盖写。
+type undoEntry struct {
+	node *mnode
+	word uint64
+}
+
+// pendingFree 是一个在 checkpoint 期间被 overwrite 顶替下来、但暂时不能
+// freePush 的旧 value 槽位, 见 checkpoint.predates。
+type pendingFree struct {
+	addr memAddr
+	size uint32
+}
+
+// insertSplice 记录一次把新 node 接入某一层链表时, 被改写的前驱节点和它当时
+// 指向的后继。Release 按逆序把 pred.tower[level] 改回 next, 相当于把这个新
+// node 从这一层摘除。
+type insertSplice struct {
+	pred  *mnode
+	level int
+	next  memAddr
+}
+
+// checkpoint 是 Staging 返回的快照。游标和 freelist 表头负责撤销这期间新分配
+// 出来的内存; 但覆盖写(overwrite)和插入新 key 改动的是 Staging 之前就存在的
+// node, 单靠游标回滚覆盖不到, 所以还需要:
+//   - undo: 每次覆盖写之前的 valueWord, Release 时逆序恢复;
+//   - deferredFree: 覆盖写释放掉的、Staging 之前就分配好的旧槽位。这些槽位
+//     在 Cleanup(提交)之前不能真的 freePush, 否则 next 指针会写进这块内存,
+//     一旦之后又 Release(回滚), undo 恢复出来的 valueWord 指向的数据已经被
+//     freelist 链表指针破坏, 恢复了也是错的。
+//   - inserts: 每一层把新 node 接入链表时改写的前驱/后继, Release 时必须先
+//     把新 node 从每一层摘除, 再回卷游标 —— 否则游标回卷之后这个新 node 占用
+//     的内存被判定为空闲、随时可能被后续分配覆盖, 而链表这时候还指着它。
+type checkpoint struct {
+	blockCursors []uint32
+	freeHeads    map[uint32]memAddr
+	height       int32
+
+	parent       *checkpoint
+	undo         []undoEntry
+	deferredFree []pendingFree
+	inserts      []insertSplice
+}
+
+// predates 判断 addr 是否是这个 checkpoint 创建之前就已经分配出来的槽位。
+func (cp *checkpoint) predates(addr memAddr) bool {
+	idx := addr.blockIdx()
+	if int(idx) >= len(cp.blockCursors) {
+		return false
+	}
+	return addr.offset() < cp.blockCursors[idx]
+}
+
+// MemDB 是一个面向事务缓冲区场景的跳表: 单 writer/多 reader, 覆盖写会把旧的
+// value 槽位还给 freelist 复用, 并且支持 Staging/Cleanup/Release 三段式的检查点,
+// 让一个事务可以在失败时把自己写入的那部分内存整体回滚掉。
+type MemDB struct {
+	height   int32
+	headAddr memAddr
+	arena    *memArena
+
+	// txn 是当前活跃的 checkpoint, 非空时 overwrite 需要把旧 valueWord 记进
+	// undo 里, 并对 Staging 之前就存在的槽位推迟 freePush。
+	txn *checkpoint
+}
+
+func NewMemDB() *MemDB {
+	arena := newMemArena()
+	headAddr, _ := newMNode(arena, nil, ValueStruct{}, maxHeight)
+	return &MemDB{
+		height:   1,
+		headAddr: headAddr,
+		arena:    arena,
+	}
+}
+
+// newMNode 和 Skiplist 的 newNode 类似, 但额外把节点自己的 memAddr 一起返回,
+// 调用方不需要像 Arena 那样反过来用指针减法算偏移量。
+func newMNode(arena *memArena, key []byte, v ValueStruct, height int) (memAddr, *mnode) {
+	nodeAddr := arena.putNode(height)
+	keyAddr := arena.putKey(key)
+	valAddr, valSize := arena.putVal(v)
+
+	n := arena.getNode(nodeAddr)
+	n.keyAddr = keyAddr
+	n.keySize = uint16(len(key))
+	n.height = uint16(height)
+	n.valueWord = packValueWord(valAddr, valSize)
+	return nodeAddr, n
+}
+
+func (db *MemDB) getHeight() int32 { return atomic.LoadInt32(&db.height) }
+
+func (db *MemDB) getHead() *mnode { return db.arena.getNode(db.headAddr) }
+
+func (db *MemDB) findSpliceForLevel(key []byte, before memAddr, level int) (memAddr, memAddr) {
+	for {
+		beforeNode := db.arena.getNode(before)
+		next := memAddr(atomic.LoadUint64((*uint64)(unsafe.Pointer(&beforeNode.tower[level]))))
+		nextNode := db.arena.getNode(next)
+		if nextNode == nil {
+			return before, next
+		}
+		nextKey := nextNode.key(db.arena)
+		cmp := CompareKeys(key, nextKey)
+		if cmp == 0 {
+			return next, next
+		}
+		if cmp < 0 {
+			return before, next
+		}
+		before = next
+	}
+}
+
+// Put 插入或者原地覆盖一个 key, 覆盖时旧的 value 槽位会被释放回 freelist。
+func (db *MemDB) Put(key []byte, v ValueStruct) {
+	listHeight := db.getHeight()
+	var prev [maxHeight + 1]memAddr
+	var next [maxHeight + 1]memAddr
+	prev[listHeight] = db.headAddr
+	for i := int(listHeight) - 1; i >= 0; i-- {
+		prev[i], next[i] = db.findSpliceForLevel(key, prev[i+1], i)
+		if prev[i] == next[i] {
+			db.overwrite(prev[i], v)
+			return
+		}
+	}
+
+	height := 1
+	for height < maxHeight && FastRand() <= heightIncrease {
+		height++
+	}
+	xAddr, x := newMNode(db.arena, key, v, height)
+
+	listHeight = db.getHeight()
+	for height > int(listHeight) {
+		if atomic.CompareAndSwapInt32(&db.height, listHeight, int32(height)) {
+			break
+		}
+		listHeight = db.getHeight()
+	}
+
+	for i := 0; i < height; i++ {
+		for {
+			if db.arena.getNode(prev[i]) == nil {
+				AssertTrue(i > 1)
+				prev[i], next[i] = db.findSpliceForLevel(key, db.headAddr, i)
+				AssertTrue(prev[i] != next[i])
+			}
+			x.tower[i] = next[i]
+			pnode := db.arena.getNode(prev[i])
+			if pnode.casNextAddr(i, next[i], xAddr) {
+				if db.txn != nil {
+					db.txn.inserts = append(db.txn.inserts, insertSplice{pred: pnode, level: i, next: next[i]})
+				}
+				break
+			}
+			prev[i], next[i] = db.findSpliceForLevel(key, prev[i], i)
+			if prev[i] == next[i] {
+				AssertTruef(i == 0, "Equality can happen only on base level: %d", i)
+				db.overwrite(prev[i], v)
+				return
+			}
+		}
+	}
+}
+
+func (db *MemDB) overwrite(addr memAddr, v ValueStruct) {
+	n := db.arena.getNode(addr)
+	oldWord := atomic.LoadUint64(&n.valueWord)
+	oldAddr, oldSize := unpackValueWord(oldWord)
+	valAddr, valSize := db.arena.putVal(v)
+	atomic.StoreUint64(&n.valueWord, packValueWord(valAddr, valSize))
+
+	if db.txn != nil {
+		db.txn.undo = append(db.txn.undo, undoEntry{node: n, word: oldWord})
+		if db.txn.predates(oldAddr) {
+			db.txn.deferredFree = append(db.txn.deferredFree, pendingFree{addr: oldAddr, size: oldSize})
+			return
+		}
+	}
+	db.arena.freePush(oldAddr, oldSize)
+}
+
+// Get 查找 key, 不存在时返回零值 ValueStruct。
+func (db *MemDB) Get(key []byte) ValueStruct {
+	n := db.getHead()
+	level := int(db.getHeight() - 1)
+	for {
+		next := n.getNext(db.arena, level)
+		if next == nil {
+			if level == 0 {
+				return ValueStruct{}
+			}
+			level--
+			continue
+		}
+		nextKey := next.key(db.arena)
+		cmp := CompareKeys(key, nextKey)
+		if cmp == 0 {
+			return next.getVs(db.arena)
+		}
+		if cmp > 0 {
+			n = next
+			continue
+		}
+		if level == 0 {
+			return ValueStruct{}
+		}
+		level--
+	}
+}
+
+// Staging 返回当前每个 block 的写游标和 freelist 表头组成的检查点, 并把它
+// 记为当前活跃事务, 后续的 overwrite 都会往这个检查点里记 undo 信息。
+func (db *MemDB) Staging() *checkpoint {
+	blocks := db.arena.loadBlocks()
+	cp := &checkpoint{
+		blockCursors: make([]uint32, len(blocks)),
+		freeHeads:    make(map[uint32]memAddr, len(db.arena.freelist)),
+		height:       db.getHeight(),
+		parent:       db.txn,
+	}
+	for i, blk := range blocks {
+		cp.blockCursors[i] = blk.n
+	}
+	for size, head := range db.arena.freelist {
+		cp.freeHeads[size] = head
+	}
+	db.txn = cp
+	return cp
+}
+
+// Cleanup 确认这期间的所有写入都保留下来: 被推迟的旧槽位现在真正归还给
+// freelist。嵌套的 checkpoint 提交时, undo/inserts 交给外层继续记着, 外层
+// Staging 之前就存在的槽位也继续推迟, 这样外层 Release 仍能撤销这些写入。
+func (db *MemDB) Cleanup(cp *checkpoint) {
+	if p := cp.parent; p != nil {
+		p.undo = append(p.undo, cp.undo...)
+		p.inserts = append(p.inserts, cp.inserts...)
+		for _, pf := range cp.deferredFree {
+			if p.predates(pf.addr) {
+				p.deferredFree = append(p.deferredFree, pf)
+			} else {
+				db.arena.freePush(pf.addr, pf.size)
+			}
+		}
+		db.txn = p
+		return
+	}
+	for _, pf := range cp.deferredFree {
+		db.arena.freePush(pf.addr, pf.size)
+	}
+	db.txn = cp.parent
+}
+
+// Release 把 arena 回滚到 Staging 时刻的状态, 丢弃掉这期间新分配的所有内存,
+// 并把这期间的覆盖写和新插入都逐一撤销, 事务回放/中止时使用。调用方必须保证
+// 这期间没有新 block 之外的并发写入。
+func (db *MemDB) Release(cp *checkpoint) {
+	// 必须先把这期间插入的 node 从每一层链表摘除, 再回卷 block 游标:
+	// 游标一回卷, 这些 node 占用的内存就会被后续分配当成空闲空间复用,
+	// 如果链表这时候还指着它们, 下一次分配就会往一个"活着"的 node 身上写,
+	// 读出来的 tower/valueWord 全是垃圾, 轻则读到错误的值, 重则数组越界崩溃。
+	// 按逆序摘除是因为后插入的 node 可能是先插入的 node 的前驱, 顺序反了会
+	// 把后插入的 node 再次挂回链表。
+	for i := len(cp.inserts) - 1; i >= 0; i-- {
+		e := cp.inserts[i]
+		e.pred.storeNextAddr(e.level, e.next)
+	}
+
+	blocks := db.arena.loadBlocks()
+	blocks = blocks[:len(cp.blockCursors)]
+	for i, blk := range blocks {
+		blk.n = cp.blockCursors[i]
+	}
+	db.arena.blocks.Store(blocks)
+	db.arena.freelist = cp.freeHeads
+	atomic.StoreInt32(&db.height, cp.height)
+
+	// deferredFree 里的槽位从来没有被真正 freePush 过, 内容还是原样,
+	// 按逆序把 undo 里记的 valueWord 恢复回去就行, 不需要额外处理它们。
+	for i := len(cp.undo) - 1; i >= 0; i-- {
+		e := cp.undo[i]
+		atomic.StoreUint64(&e.node.valueWord, e.word)
+	}
+	db.txn = cp.parent
+}
+
+// MemDBIterator 是 MemDB 上和 Iterator 接口兼容的前向迭代器。
+type MemDBIterator struct {
+	db *MemDB
+	n  *mnode
+}
+
+func (db *MemDB) NewIterator() Iterator {
+	return &MemDBIterator{db: db}
+}
+
+func (it *MemDBIterator) Rewind() { it.SeekToFirst() }
+
+func (it *MemDBIterator) Item() Item {
+	vs := it.Value()
+	return &Entry{
+		Key:       it.Key(),
+		Value:     vs.Value,
+		ExpiresAt: vs.ExpiresAt,
+		Meta:      vs.Meta,
+		Version:   vs.Version,
+	}
+}
+
+func (it *MemDBIterator) Close() error { return nil }
+
+func (it *MemDBIterator) Valid() bool { return it.n != nil }
+
+func (it *MemDBIterator) Key() []byte { return it.n.key(it.db.arena) }
+
+func (it *MemDBIterator) Value() ValueStruct { return it.n.getVs(it.db.arena) }
+
+func (it *MemDBIterator) Next() {
+	AssertTrue(it.Valid())
+	it.n = it.n.getNext(it.db.arena, 0)
+}
+
+func (it *MemDBIterator) Seek(target []byte) {
+	n := it.db.getHead()
+	level := int(it.db.getHeight() - 1)
+	for {
+		next := n.getNext(it.db.arena, level)
+		if next == nil {
+			if level == 0 {
+				it.n = nil
+				return
+			}
+			level--
+			continue
+		}
+		cmp := CompareKeys(target, next.key(it.db.arena))
+		if cmp <= 0 {
+			if level == 0 {
+				it.n = next
+				return
+			}
+			level--
+			continue
+		}
+		n = next
+	}
+}
+
+func (it *MemDBIterator) SeekToFirst() {
+	it.n = it.db.getHead().getNext(it.db.arena, 0)
+}
@@ -4,8 +4,10 @@ import (
 	"github.com/pkg/errors"
 	"log"
 	"math"
+	"sort"
+	"sync"
 	"sync/atomic"
-	_ "unsafe"
+	"unsafe"
 )
 
 const (
@@ -13,6 +15,16 @@ const (
 	heightIncrease = math.MaxUint32 / 3
 )
 
+// link 把某一层的 next/prev 指针打包在一起, 这样 Arena.putNode 按 height 裁掉
+// 尾部用不上的层数时, 两个方向的指针是一起被裁掉的, node 在内存里仍然是连续
+// 的一段, 不会出现 tower 裁完了、prev 还悬在后面访问越界的情况。
+type link struct {
+	next uint32
+	prev uint32
+}
+
+const linkSize = int(unsafe.Sizeof(link{}))
+
 type node struct {
 	value uint64
 
@@ -22,8 +34,11 @@ type node struct {
 	// 当前node的最高层高
 	height uint16
 
-	// 当前节点的所有next指针
-	tower [maxHeight]uint32
+	// 当前节点每一层的 next/prev 指针。prev 是 advisory 的: 它只是一个用来
+	// 把反向遍历做到均摊 O(1) 的 hint, 并发插入可能让它变得不是最新的前驱,
+	// 读者发现 hint 在 level 0 的 next 不再指回自己时, 会退回正向扫描修正,
+	// 写者这边的正确性和原来无锁的 Pugh 算法完全一样。
+	tower [maxHeight]link
 }
 
 // 一个跳表的结构
@@ -32,9 +47,51 @@ type Skiplist struct {
 	headOffset uint32
 	ref        int32 // 引用计数
 	arena      *Arena
+	cmp        KeyComparator
 	OnClose    func()
+
+	// rangeMu 保护 ranges, 范围删除很少发生, 用一把锁而不是无锁结构就够了,
+	// 不会和跳表本身的无锁读写路径打架。
+	rangeMu sync.RWMutex
+	ranges  []rangeTombstone
 }
 
+// rangeTombstone 是一个 [start, end) 半开区间的范围删除墓碑, 由 DeleteRange 写入,
+// 被 Search 和 SkipListIterator 用来判断一个原本在跳表里不存在的 key 到底是
+// "从来没写过"还是"曾经被范围删除覆盖"。
+type rangeTombstone struct {
+	start, end []byte
+}
+
+// KeyComparator 决定跳表怎么比较/判等两个 key, 以及在两个 key 之间取一个分隔符
+// (给上层 compaction 之类场景用)。defaultComparator 就是现有这套 MVCC 时间戳
+// 后缀的比较逻辑; 把跳表当成非 KV 场景的数据结构用(比如按裸字节比较、不带版本
+// 后缀的锁表)时, 可以传入自己的 KeyComparator, 避免 ParseKey 无条件砍掉 key
+// 最后 8 个字节, 砍坏长度不超过 8 或者本来就没有版本后缀的 key。
+type KeyComparator interface {
+	Compare(a, b []byte) int
+	SameKey(a, b []byte) bool
+	Separator(a, b []byte) []byte
+
+	// Timestamp 从 key 里解析出版本号, 供 Search 填充 ValueStruct.ExpiresAt 用。
+	// 非 MVCC 的 KeyComparator(比如裸字节比较的锁表)应该让它返回 0, 否则
+	// Search 会把 key 最后 8 个字节当成时间戳编出一个假的 ExpiresAt。
+	Timestamp(key []byte) uint64
+}
+
+// defaultComparator 是当前 Skiplist 一直以来的行为: key 末尾 8 字节是版本号,
+// 比较、判等、取时间戳都要先把它解析出来。
+type defaultComparator struct{}
+
+func (defaultComparator) Compare(a, b []byte) int  { return CompareKeys(a, b) }
+func (defaultComparator) SameKey(a, b []byte) bool { return SameKey(a, b) }
+
+// Separator 默认返回 b 去掉版本后缀之后的部分, 足够当 compaction 之类场景里
+// 两个 key 之间的分隔符使用。
+func (defaultComparator) Separator(a, b []byte) []byte { return ParseKey(b) }
+
+func (defaultComparator) Timestamp(key []byte) uint64 { return ParseTs(key) }
+
 func (s *Skiplist) IncrRef() {
 	atomic.AddInt32(&s.ref, 1)
 }
@@ -65,6 +122,20 @@ func newNode(arena *Arena, key []byte, v ValueStruct, height int) *node {
 	return node
 }
 
+// newUint64Node 和 newNode 类似, 但是不经过 ValueStruct 编码, 把 v 直接塞进
+// node.value 这 8 个字节里, 省掉了给 value 单独分配 Arena 空间的开销。
+func newUint64Node(arena *Arena, key []byte, v uint64, height int) *node {
+	nodeOffset := arena.putNode(height)
+	keyOffset := arena.putKey(key)
+
+	node := arena.getNode(nodeOffset)
+	node.keyOffset = keyOffset
+	node.keySize = uint16(len(key))
+	node.height = uint16(height)
+	node.value = v
+	return node
+}
+
 func encodeValue(valOffset uint32, valSize uint32) uint64 {
 	return uint64(valSize)<<32 | uint64(valOffset)
 }
@@ -76,6 +147,13 @@ func decodeValue(value uint64) (valOffset uint32, valSize uint32) {
 }
 
 func NewSkiplist(arenaSize int64) *Skiplist {
+	return NewSkiplistWithComparator(arenaSize, defaultComparator{})
+}
+
+// NewSkiplistWithComparator 和 NewSkiplist 一样, 但是允许传入自定义的
+// KeyComparator, 用来把跳表的 key 比较/判等逻辑从写死的 MVCC 时间戳后缀
+// 解绑出来, 供非 KV 场景(比如裸字节比较的锁表)复用这套跳表实现。
+func NewSkiplistWithComparator(arenaSize int64, cmp KeyComparator) *Skiplist {
 	arena := newArena(arenaSize)
 	head := newNode(arena, nil, ValueStruct{}, maxHeight)
 	ho := arena.getNodeOffset(head)
@@ -83,10 +161,41 @@ func NewSkiplist(arenaSize int64) *Skiplist {
 		height:     1,
 		headOffset: ho,
 		arena:      arena,
+		cmp:        cmp,
 		ref:        1,
 	}
 }
 
+// NewSkiplistFromFile 用 mmap 把 path 映射为跳表的底层内存, 这样跳表里的数据
+// 可以跨进程重启持久化下来。Arena 扩容时会 ftruncate + mmap 重新映射(旧映射
+// 留到 Close 时才 munmap), 而不是像普通 Arena 那样整体 copy 一份新 buf。
+func NewSkiplistFromFile(path string, size int64) (*Skiplist, error) {
+	arena, err := newArenaFromFile(path, size)
+	if err != nil {
+		return nil, err
+	}
+	arena.shouldGrow = true
+	head := newNode(arena, nil, ValueStruct{}, maxHeight)
+	ho := arena.getNodeOffset(head)
+	return &Skiplist{
+		height:     1,
+		headOffset: ho,
+		arena:      arena,
+		cmp:        defaultComparator{},
+		ref:        1,
+	}, nil
+}
+
+// Sync 把 mmap 支持的跳表内存刷回磁盘, 非文件支持的跳表是空操作。
+func (s *Skiplist) Sync() error {
+	return s.arena.sync()
+}
+
+// Close 解除 mmap 映射并关闭底层文件, 非文件支持的跳表是空操作。
+func (s *Skiplist) Close() error {
+	return s.arena.close()
+}
+
 func (n *node) getValueOffset() (uint32, uint32) {
 	value := atomic.LoadUint64(&n.value)
 	return decodeValue(value)
@@ -101,11 +210,21 @@ func (n *node) setValue(vo uint64) {
 }
 
 func (n *node) getNextOffset(h int) uint32 {
-	return atomic.LoadUint32(&n.tower[h])
+	return atomic.LoadUint32(&n.tower[h].next)
 }
 
 func (n *node) casNextOffset(h int, old, val uint32) bool {
-	return atomic.CompareAndSwapUint32(&n.tower[h], old, val)
+	return atomic.CompareAndSwapUint32(&n.tower[h].next, old, val)
+}
+
+// getPrevOffset/casPrevOffset 操作的是 advisory 的反向 back-link, 见 node.tower
+// 的注释。
+func (n *node) getPrevOffset(h int) uint32 {
+	return atomic.LoadUint32(&n.tower[h].prev)
+}
+
+func (n *node) casPrevOffset(h int, old, val uint32) bool {
+	return atomic.CompareAndSwapUint32(&n.tower[h].prev, old, val)
 }
 
 func (n *node) getVs(arena *Arena) ValueStruct {
@@ -154,7 +273,7 @@ func (s *Skiplist) findNear(key []byte, less bool, allowEqual bool) (*node, bool
 		}
 
 		nextKey := next.key(s.arena)
-		cmp := CompareKeys(key, nextKey)
+		cmp := s.cmp.Compare(key, nextKey)
 		if cmp > 0 {
 			// x.key < next.key < key. We can continue to move right.
 			x = next
@@ -208,7 +327,7 @@ func (s *Skiplist) findSpliceForLevel(key []byte, before uint32, level int) (uin
 			return before, next
 		}
 		nextKey := nextNode.key(s.arena)
-		cmp := CompareKeys(key, nextKey)
+		cmp := s.cmp.Compare(key, nextKey)
 		if cmp == 0 {
 			// Equality case.
 			return next, next
@@ -268,9 +387,17 @@ func (s *Skiplist) Add(e *Entry) {
 
 				AssertTrue(prev[i] != next[i])
 			}
-			x.tower[i] = next[i]
+			x.tower[i].next = next[i]
+			x.tower[i].prev = prev[i]
+			xOffset := s.arena.getNodeOffset(x)
 			pnode := s.arena.getNode(prev[i])
-			if pnode.casNextOffset(i, next[i], s.arena.getNodeOffset(x)) {
+			if pnode.casNextOffset(i, next[i], xOffset) {
+				// 前向 CAS 成功之后, 顺手把后继节点在这一层的 back-link 改指向
+				// x。这只是个 hint, CAS 失败(被别的写者抢先改过)也不影响
+				// 正确性, 读者发现 hint 失效时会退回正向扫描修正。
+				if nextNode := s.arena.getNode(next[i]); nextNode != nil {
+					nextNode.casPrevOffset(i, prev[i], xOffset)
+				}
 				break
 			}
 			prev[i], next[i] = s.findSpliceForLevel(key, prev[i], i)
@@ -286,10 +413,156 @@ func (s *Skiplist) Add(e *Entry) {
 	}
 }
 
+// PutUint64 把 v 原地存进 node.value, 不走 ValueStruct 编码, 也不在 Arena 里
+// 为 value 分配空间, 适合 counter/offset 这类定长小数据, 配合 GetUint64 使用。
+func (s *Skiplist) PutUint64(key []byte, v uint64) {
+	listHeight := s.getHeight()
+	var prev [maxHeight + 1]uint32
+	var next [maxHeight + 1]uint32
+	prev[listHeight] = s.headOffset
+	for i := int(listHeight) - 1; i >= 0; i-- {
+		prev[i], next[i] = s.findSpliceForLevel(key, prev[i+1], i)
+		if prev[i] == next[i] {
+			prevNode := s.arena.getNode(prev[i])
+			prevNode.setValue(v)
+			return
+		}
+	}
+	height := s.randomHeight()
+	x := newUint64Node(s.arena, key, v, height)
+
+	// Try to increase s.height via CAS.
+	listHeight = s.getHeight()
+	for height > int(listHeight) {
+		if atomic.CompareAndSwapInt32(&s.height, listHeight, int32(height)) {
+			break
+		}
+		listHeight = s.getHeight()
+	}
+
+	for i := 0; i < height; i++ {
+		for {
+			if s.arena.getNode(prev[i]) == nil {
+				AssertTrue(i > 1)
+				prev[i], next[i] = s.findSpliceForLevel(key, s.headOffset, i)
+				AssertTrue(prev[i] != next[i])
+			}
+			x.tower[i].next = next[i]
+			x.tower[i].prev = prev[i]
+			xOffset := s.arena.getNodeOffset(x)
+			pnode := s.arena.getNode(prev[i])
+			if pnode.casNextOffset(i, next[i], xOffset) {
+				if nextNode := s.arena.getNode(next[i]); nextNode != nil {
+					nextNode.casPrevOffset(i, prev[i], xOffset)
+				}
+				break
+			}
+			prev[i], next[i] = s.findSpliceForLevel(key, prev[i], i)
+			if prev[i] == next[i] {
+				AssertTruef(i == 0, "Equality can happen only on base level: %d", i)
+				prevNode := s.arena.getNode(prev[i])
+				prevNode.setValue(v)
+				return
+			}
+		}
+	}
+}
+
+// GetUint64 读出通过 PutUint64 写入的原始 uint64, 不经过 ValueStruct 解码。
+func (s *Skiplist) GetUint64(key []byte) (uint64, bool) {
+	n, _ := s.findNear(key, false, true) // findGreaterOrEqual.
+	if n == nil {
+		return 0, false
+	}
+
+	nextKey := s.arena.getKey(n.keyOffset, n.keySize)
+	if !s.cmp.SameKey(key, nextKey) {
+		return 0, false
+	}
+	return atomic.LoadUint64(&n.value), true
+}
+
+// Delete 给 key 写入一个删除墓碑, 而不是把节点从链表里摘掉 —— 并发场景下摘链表
+// 节点代价高还容易和其他写者的 CAS 打架, 墓碑让 Search 能区分"key 不存在"和
+// "key 曾经写过, 现在被显式删除了"这两种情况, 便于上层 LSM 正确遮蔽更老的 SSTable。
+func (s *Skiplist) Delete(key []byte) {
+	s.Add(&Entry{Key: key, Meta: BitDelete})
+}
+
+// DeleteRange 记录一个 [start, end) 的范围删除墓碑。它不会立刻触碰跳表里已有的
+// 节点, 只是让之后的 Search / SkipListIterator 在读到这个区间内的 key 时,
+// 把它当成已删除处理。新区间会和所有与它重叠或者相邻的已有区间合并成一个, 使
+// ranges 始终是一组按 start 排好序、两两不重叠的区间 —— isRangeDeleted 才能
+// 只看二分定位到的那一个候选区间就判断出 key 有没有被覆盖, 而不用在嵌套/交叠
+// 的范围删除之间漏掉命中。
+func (s *Skiplist) DeleteRange(start, end []byte) {
+	s.rangeMu.Lock()
+	defer s.rangeMu.Unlock()
+
+	newStart := append([]byte(nil), start...)
+	newEnd := append([]byte(nil), end...)
+
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.cmp.Compare(s.ranges[i].start, newStart) >= 0
+	})
+
+	// 往左吸收一个和 newStart 重叠/相邻的已有区间(在维持不变式的前提下, 最多
+	// 只会有这一个)。
+	lo := i
+	if lo > 0 && s.cmp.Compare(s.ranges[lo-1].end, newStart) >= 0 {
+		lo--
+		newStart = s.ranges[lo].start
+	}
+
+	// 往右吸收所有 start <= newEnd 的区间, 把 newEnd 扩展成它们里面最大的 end。
+	hi := lo
+	for hi < len(s.ranges) && s.cmp.Compare(s.ranges[hi].start, newEnd) <= 0 {
+		if s.cmp.Compare(s.ranges[hi].end, newEnd) > 0 {
+			newEnd = s.ranges[hi].end
+		}
+		hi++
+	}
+
+	merged := rangeTombstone{start: newStart, end: newEnd}
+	tail := append([]rangeTombstone{merged}, s.ranges[hi:]...)
+	s.ranges = append(s.ranges[:lo], tail...)
+}
+
+// isRangeDeleted 判断 key 是否落在某个已经记录的范围删除墓碑里。
+func (s *Skiplist) isRangeDeleted(key []byte) bool {
+	s.rangeMu.RLock()
+	defer s.rangeMu.RUnlock()
+
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return s.cmp.Compare(s.ranges[i].start, key) > 0
+	})
+	if i == 0 {
+		return false
+	}
+	r := s.ranges[i-1]
+	return s.cmp.Compare(key, r.start) >= 0 && s.cmp.Compare(key, r.end) < 0
+}
+
 func (s *Skiplist) Empty() bool {
 	return s.findLast() == nil
 }
 
+// prevNode 返回 nd 在 level 0 上的前驱, 均摊 O(1): 正常情况下直接用 nd 自己的
+// back-link; 如果这个 hint 已经不是最新的前驱了(并发插入把它挤到中间去了,
+// 表现为 hint 在 level 0 的 next 不再指回 nd), 就退回到从 head 开始的正向
+// 扫描来修正, 见 node.tower 的注释。
+func (s *Skiplist) prevNode(nd *node) *node {
+	hint := s.arena.getNode(nd.getPrevOffset(0))
+	if hint != nil && s.getNext(hint, 0) == nd {
+		if hint == s.getHead() {
+			return nil
+		}
+		return hint
+	}
+	n, _ := s.findNear(nd.key(s.arena), true, false) // find <. No equality allowed.
+	return n
+}
+
 func (s *Skiplist) findLast() *node {
 	n := s.getHead()
 	level := int(s.getHeight()) - 1
@@ -309,20 +582,33 @@ func (s *Skiplist) findLast() *node {
 	}
 }
 
+// Search 返回 key 对应的 ValueStruct。和插入/删除都没发生过的情况不同, 显式
+// Delete 过的 key(以及被 DeleteRange 覆盖的 key)会返回一个 Meta 设置了
+// BitDelete 的非零 ValueStruct, 调用方据此区分"没写过"和"写过又删了", 这样
+// 外层 LSM 才能正确地用墓碑遮蔽更老的 SSTable, 而不是把两者都当成"没有"。
 func (s *Skiplist) Search(key []byte) ValueStruct {
 	n, _ := s.findNear(key, false, true) // findGreaterOrEqual.
 	if n == nil {
+		if s.isRangeDeleted(key) {
+			return ValueStruct{Meta: BitDelete}
+		}
 		return ValueStruct{}
 	}
 
 	nextKey := s.arena.getKey(n.keyOffset, n.keySize)
-	if !SameKey(key, nextKey) {
+	if !s.cmp.SameKey(key, nextKey) {
+		if s.isRangeDeleted(key) {
+			return ValueStruct{Meta: BitDelete}
+		}
 		return ValueStruct{}
 	}
 
 	valOffset, valSize := n.getValueOffset()
 	vs := s.arena.getVal(valOffset, valSize)
-	vs.ExpiresAt = ParseTs(nextKey)
+	vs.ExpiresAt = s.cmp.Timestamp(nextKey)
+	if vs.Meta&BitDelete == 0 && s.isRangeDeleted(key) {
+		vs.Meta |= BitDelete
+	}
 	return vs
 }
 
@@ -336,6 +622,33 @@ func (s *Skiplist) MemSize() int64 { return s.arena.size() }
 type SkipListIterator struct {
 	list *Skiplist
 	n    *node
+
+	// SkipTombstones 为 true 时, 迭代器会跳过点删除墓碑和被 DeleteRange 覆盖
+	// 的 key, 普通读者应该打开它; compactor 需要看到墓碑才能知道哪些 key 要
+	// 跟着一起从下层 SSTable 清理掉, 应该保持它关闭。
+	SkipTombstones bool
+}
+
+// isTombstone 判断迭代器当前位置是不是一个应该被隐藏的墓碑。
+func (s *SkipListIterator) isTombstone() bool {
+	valOffset, valSize := s.n.getValueOffset()
+	vs := s.list.arena.getVal(valOffset, valSize)
+	if vs.Meta&BitDelete != 0 {
+		return true
+	}
+	return s.list.isRangeDeleted(s.Key())
+}
+
+// skipTombstones 在 SkipTombstones 打开时跳过当前位置开始的所有墓碑, forward
+// 为 true 走 Next 的方向, 否则走 Prev 的方向。
+func (s *SkipListIterator) skipTombstones(forward bool) {
+	for s.SkipTombstones && s.Valid() && s.isTombstone() {
+		if forward {
+			s.n = s.list.getNext(s.n, 0)
+		} else {
+			s.n = s.list.prevNode(s.n)
+		}
+	}
 }
 
 func (s *SkipListIterator) Rewind() {
@@ -378,27 +691,37 @@ func (s *SkipListIterator) ValueUint64() uint64 {
 func (s *SkipListIterator) Next() {
 	AssertTrue(s.Valid())
 	s.n = s.list.getNext(s.n, 0)
+	s.skipTombstones(true)
 }
 
+// Prev moves to the predecessor at level 0. It is amortized O(1) via the
+// node's back-link, falling back to a forward re-scan from head only when
+// a concurrent insert has made the cached back-link stale; see
+// Skiplist.prevNode.
 func (s *SkipListIterator) Prev() {
 	AssertTrue(s.Valid())
-	s.n, _ = s.list.findNear(s.Key(), true, false) // find <. No equality allowed.
+	s.n = s.list.prevNode(s.n)
+	s.skipTombstones(false)
 }
 
 func (s *SkipListIterator) Seek(target []byte) {
 	s.n, _ = s.list.findNear(target, false, true) // find >=.
+	s.skipTombstones(true)
 }
 
 func (s *SkipListIterator) SeekForPrev(target []byte) {
 	s.n, _ = s.list.findNear(target, true, true) // find <=.
+	s.skipTombstones(false)
 }
 
 func (s *SkipListIterator) SeekToFirst() {
 	s.n = s.list.getNext(s.list.getHead(), 0)
+	s.skipTombstones(true)
 }
 
 func (s *SkipListIterator) SeekToLast() {
 	s.n = s.list.findLast()
+	s.skipTombstones(false)
 }
 
 type UniIterator struct {